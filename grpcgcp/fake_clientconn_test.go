@@ -0,0 +1,112 @@
+/*
+ *
+ * Copyright 2018 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package grpcgcp
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/resolver"
+)
+
+// fakeSubConn is a balancer.SubConn double that just records calls.
+type fakeSubConn struct {
+	mu    sync.Mutex
+	addrs []resolver.Address
+}
+
+func (f *fakeSubConn) UpdateAddresses(addrs []resolver.Address) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.addrs = addrs
+}
+
+func (f *fakeSubConn) Connect() {}
+
+// fakeClientConn is a balancer.ClientConn double that hands out fakeSubConns
+// and records every RemoveSubConn/UpdateState call for assertions.
+type fakeClientConn struct {
+	mu         sync.Mutex
+	subConns   []*fakeSubConn
+	removed    []balancer.SubConn
+	stateCalls []balancer.State
+}
+
+func (f *fakeClientConn) NewSubConn(addrs []resolver.Address, _ balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	sc := &fakeSubConn{addrs: addrs}
+	f.mu.Lock()
+	f.subConns = append(f.subConns, sc)
+	f.mu.Unlock()
+	return sc, nil
+}
+
+func (f *fakeClientConn) RemoveSubConn(sc balancer.SubConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.removed = append(f.removed, sc)
+}
+
+func (f *fakeClientConn) UpdateAddresses(balancer.SubConn, []resolver.Address) {}
+
+func (f *fakeClientConn) UpdateState(s balancer.State) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stateCalls = append(f.stateCalls, s)
+}
+
+func (f *fakeClientConn) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (f *fakeClientConn) Target() string { return "fake" }
+
+func (f *fakeClientConn) subConnCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subConns)
+}
+
+func (f *fakeClientConn) subConnAt(i int) *fakeSubConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.subConns[i]
+}
+
+func (f *fakeClientConn) removedCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.removed)
+}
+
+// waitUntil polls cond until it returns true, or fails the test once
+// timeout elapses. It exists because pool growth and draining happen on
+// background goroutines spawned by the code under test.
+func waitUntil(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !cond() {
+		t.Fatalf("condition not met within %s", timeout)
+	}
+}
@@ -21,6 +21,7 @@ package grpcgcp
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"google.golang.org/grpc/balancer"
 
@@ -38,6 +39,11 @@ const (
 	defaultMaxStream = 100
 
 	healthCheckEnabled = true
+
+	// defaultDrainTimeout is the fallback GcpBalancerConfig.drainTimeout
+	// when the service config doesn't set channelPool.drainTimeoutSeconds.
+	defaultDrainTimeout = 10 * time.Second
+	drainCheckInterval  = 100 * time.Millisecond
 )
 
 func init() {
@@ -60,7 +66,7 @@ func (bb *gcpBalancerBuilder) Build(
 		csEvltr:     &ConnectivityStateEvaluator{},
 		// Initialize picker to a picker that always return
 		// ErrNoSubConnAvailable, because when state of a SubConn changes, we
-		// may call UpdateBalancerState with this picker.
+		// may call UpdateState with this picker.
 		picker: newErrPicker(balancer.ErrNoSubConnAvailable),
 	}
 }
@@ -156,29 +162,60 @@ type gcpBalancer struct {
 	scRefs      map[balancer.SubConn]*subConnRef
 
 	picker balancer.Picker
+
+	// cfg holds the most recently parsed grpc_gcp ApiConfig (*GcpBalancerConfig),
+	// or nil if none was supplied via the service config. It is read by
+	// gcpPicker.Pick under p.mu, a different lock than gb.mu, so it's
+	// stored as an atomic.Value rather than a plain field; use loadCfg and
+	// storeCfg rather than touching it directly.
+	cfg atomic.Value
+
+	// shutdown is set once Close has been called; new RPCs are failed and
+	// state changes stop regenerating a normal picker.
+	shutdown bool
 }
 
-func (gb *gcpBalancer) HandleResolvedAddrs(addrs []resolver.Address, err error) {
-	if err != nil {
-		grpclog.Infof(
-			"grpcgcp.gcpBalancer: HandleResolvedAddrs called with error %v",
-			err,
-		)
-		return
+// loadCfg returns the most recently stored config, or nil if none has been
+// stored yet.
+func (gb *gcpBalancer) loadCfg() *GcpBalancerConfig {
+	cfg, _ := gb.cfg.Load().(*GcpBalancerConfig)
+	return cfg
+}
+
+// storeCfg atomically replaces the config consulted by loadCfg.
+func (gb *gcpBalancer) storeCfg(cfg *GcpBalancerConfig) {
+	gb.cfg.Store(cfg)
+}
+
+// UpdateClientConnState is called by gRPC when the state of the ClientConn
+// changes, including the first time the resolver produces a set of
+// addresses and whenever the service config is updated.
+func (gb *gcpBalancer) UpdateClientConnState(ccs balancer.ClientConnState) error {
+	grpclog.Infoln("grpcgcp.gcpBalancer: got new resolved addresses: ", ccs.ResolverState.Addresses)
+	gb.addrs = ccs.ResolverState.Addresses
+
+	if cfg, ok := ccs.BalancerConfig.(*GcpBalancerConfig); ok {
+		gb.storeCfg(cfg)
 	}
-	grpclog.Infoln("grpcgcp.gcpBalancer: got new resolved addresses: ", addrs)
-	gb.addrs = addrs
 
 	if len(gb.scRefs) == 0 {
 		gb.newSubConn()
-		return
+		return nil
 	}
 
 	for _, scRef := range gb.scRefs {
 		// TODO(weiranf): update streams count when new addrs resolved?
-		scRef.subConn.UpdateAddresses(addrs)
+		scRef.subConn.UpdateAddresses(gb.addrs)
 		scRef.subConn.Connect()
 	}
+	return nil
+}
+
+// ResolverError is called by gRPC when the resolver reports an error.
+// gcpBalancer has nothing resolver-specific to do about it beyond logging;
+// the SubConns already created keep using their last good addresses.
+func (gb *gcpBalancer) ResolverError(err error) {
+	grpclog.Errorf("grpcgcp.gcpBalancer: resolver error: %v", err)
 }
 
 // check current connection pool size
@@ -188,11 +225,22 @@ func (gb *gcpBalancer) getConnectionPoolSize() int {
 	return len(gb.scRefs)
 }
 
-// newSubConn creates a new SubConn using cc.NewSubConn and initialize the subConnRef.
+// newSubConn creates a new SubConn using cc.NewSubConn and initialize the
+// subConnRef. It is a no-op once gb.shutdown is set, so a pick racing
+// Close (which can still be running against the pre-Close picker) can't
+// insert a SubConn that Close's drain snapshot will never see.
 func (gb *gcpBalancer) newSubConn() {
 	gb.mu.Lock()
 	defer gb.mu.Unlock()
 
+	if gb.shutdown {
+		return
+	}
+
+	if len(gb.scRefs) >= gb.loadCfg().maxSize() {
+		return
+	}
+
 	// there are chances the newly created subconns are still connecting,
 	// we can wait on those new subconns.
 	for _, scState := range gb.scStates {
@@ -260,10 +308,11 @@ func (gb *gcpBalancer) unbindSubConn(boundKey string) {
 
 // regeneratePicker takes a snapshot of the balancer, and generates a picker
 // from it. The picker is
-//  - errPicker with ErrTransientFailure if the balancer is in TransientFailure,
+//  - errPicker with ErrTransientFailure if the balancer is shutting down or
+//    in TransientFailure,
 //  - built by the pickerBuilder with all READY SubConns otherwise.
 func (gb *gcpBalancer) regeneratePicker() {
-	if gb.state == connectivity.TransientFailure {
+	if gb.shutdown || gb.state == connectivity.TransientFailure {
 		gb.picker = newErrPicker(balancer.ErrTransientFailure)
 		return
 	}
@@ -278,7 +327,9 @@ func (gb *gcpBalancer) regeneratePicker() {
 	gb.picker = newGCPPicker(readyRefs, gb)
 }
 
-func (gb *gcpBalancer) HandleSubConnStateChange(sc balancer.SubConn, s connectivity.State) {
+// UpdateSubConnState is called by gRPC when the state of a SubConn changes.
+func (gb *gcpBalancer) UpdateSubConnState(sc balancer.SubConn, scs balancer.SubConnState) {
+	s := scs.ConnectivityState
 	grpclog.Infof("grpcgcp.gcpBalancer: handle SubConn state change: %p, %v", sc, s)
 
 	gb.mu.Lock()
@@ -313,9 +364,63 @@ func (gb *gcpBalancer) HandleSubConnStateChange(sc balancer.SubConn, s connectiv
 	if (s == connectivity.Ready) != (oldS == connectivity.Ready) ||
 		(gb.state == connectivity.TransientFailure) != (oldAggrState == connectivity.TransientFailure) {
 		gb.regeneratePicker()
-		gb.cc.UpdateBalancerState(gb.state, gb.picker)
+		gb.cc.UpdateState(balancer.State{ConnectivityState: gb.state, Picker: gb.picker})
 	}
 }
 
+// Close marks gb as shutting down so the picker fails new RPCs with
+// ErrTransientFailure, then drains and removes every SubConn in the pool
+// and clears the affinity map.
 func (gb *gcpBalancer) Close() {
+	gb.mu.Lock()
+	if gb.shutdown {
+		gb.mu.Unlock()
+		return
+	}
+	gb.shutdown = true
+	refs := make([]*subConnRef, 0, len(gb.scRefs))
+	for _, ref := range gb.scRefs {
+		refs = append(refs, ref)
+	}
+	gb.affinityMap = make(map[string]balancer.SubConn)
+	gb.mu.Unlock()
+
+	gb.regeneratePicker()
+	gb.cc.UpdateState(balancer.State{ConnectivityState: connectivity.TransientFailure, Picker: gb.picker})
+
+	var wg sync.WaitGroup
+	for _, ref := range refs {
+		wg.Add(1)
+		go func(sc balancer.SubConn) {
+			defer wg.Done()
+			gb.DrainSubConn(sc)
+		}(ref.subConn)
+	}
+	wg.Wait()
+}
+
+// DrainSubConn waits for sc's in-flight streams to finish, or for the
+// configured drain timeout to elapse, whichever happens first, then
+// removes sc from the ClientConn and the pool. Close, which uses it to tear
+// down every SubConn on shutdown, is its only caller; the pool is not
+// shrunk anywhere else in this package.
+func (gb *gcpBalancer) DrainSubConn(sc balancer.SubConn) {
+	gb.mu.Lock()
+	ref, ok := gb.scRefs[sc]
+	gb.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	deadline := time.Now().Add(gb.loadCfg().drainTimeout())
+	for atomic.LoadInt32(&ref.streamsCnt) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainCheckInterval)
+	}
+
+	gb.mu.Lock()
+	delete(gb.scRefs, sc)
+	delete(gb.scStates, sc)
+	gb.mu.Unlock()
+
+	gb.cc.RemoveSubConn(sc)
 }
\ No newline at end of file
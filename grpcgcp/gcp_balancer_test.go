@@ -0,0 +1,97 @@
+/*
+ *
+ * Copyright 2018 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package grpcgcp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestCloseWaitsForInFlightStreamsBeforeRemoving(t *testing.T) {
+	cc := &fakeClientConn{}
+	cfg := &GcpBalancerConfig{ChannelPool: &channelPoolConfig{DrainTimeoutSeconds: 5}}
+	gb := newTestBalancer(cc, cfg)
+	gb.addrs = []resolver.Address{{Addr: "127.0.0.1:1"}}
+
+	gb.newSubConn()
+	sc := cc.subConnAt(0)
+	gb.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	ref := gb.scRefs[sc]
+	ref.streamsIncr() // Simulate one in-flight stream on sc.
+
+	done := make(chan struct{})
+	go func() {
+		gb.Close()
+		close(done)
+	}()
+
+	// While the stream is still in flight, Close must not remove sc.
+	time.Sleep(50 * time.Millisecond)
+	if got := cc.removedCount(); got != 0 {
+		t.Fatalf("removedCount() = %d while a stream is still in flight, want 0", got)
+	}
+
+	ref.streamsDecr() // The in-flight stream finishes.
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close() did not return after its last in-flight stream finished")
+	}
+	if got := cc.removedCount(); got != 1 {
+		t.Fatalf("removedCount() = %d after Close(), want 1", got)
+	}
+}
+
+func TestCloseUnblocksPendingPicksWithTransientFailure(t *testing.T) {
+	cc := &fakeClientConn{}
+	gb := newTestBalancer(cc, &GcpBalancerConfig{})
+	gb.addrs = []resolver.Address{{Addr: "127.0.0.1:1"}}
+
+	gb.newSubConn()
+	sc := cc.subConnAt(0)
+	gb.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+
+	gb.Close()
+
+	_, err := gb.picker.Pick(balancer.PickInfo{Ctx: context.Background()})
+	if err != balancer.ErrTransientFailure {
+		t.Fatalf("Pick() error after Close() = %v, want %v", err, balancer.ErrTransientFailure)
+	}
+}
+
+func TestClosePreventsNewSubConnFromLeaking(t *testing.T) {
+	// A newSubConn call racing a concurrent Close must not insert a
+	// SubConn that Close's drain snapshot has already missed.
+	cc := &fakeClientConn{}
+	gb := newTestBalancer(cc, &GcpBalancerConfig{})
+	gb.addrs = []resolver.Address{{Addr: "127.0.0.1:1"}}
+
+	gb.Close()
+	gb.newSubConn()
+
+	if got := cc.subConnCount(); got != 0 {
+		t.Fatalf("subConnCount() after newSubConn() raced Close() = %d, want 0", got)
+	}
+}
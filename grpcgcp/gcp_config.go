@@ -0,0 +1,161 @@
+/*
+ *
+ * Copyright 2018 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package grpcgcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// AffinityCommand is the action a method's affinity config takes on the
+// affinity key: consult it to pick a SubConn (BOUND), bind it to one (BIND),
+// or consult it and then release its binding (UNBIND).
+// It mirrors the grpc_gcp.AffinityConfig.Command enum used by the
+// C++/Java/Python grpc_gcp implementations.
+type AffinityCommand string
+
+const (
+	// BOUND routes the RPC to the SubConn already bound to the affinity
+	// key found in the request message.
+	BOUND AffinityCommand = "BOUND"
+	// BIND binds the affinity key found in the response message to the
+	// SubConn the RPC was sent on.
+	BIND AffinityCommand = "BIND"
+	// UNBIND releases the binding for the affinity key found in the
+	// response message once the RPC completes.
+	UNBIND AffinityCommand = "UNBIND"
+)
+
+// AffinityConfig describes how a single method binds or consults an
+// affinity key, as found in the grpc_gcp ApiConfig's method.affinity field.
+type AffinityConfig struct {
+	Command AffinityCommand `json:"command"`
+	// AffinityKey is the dotted field path (e.g. "metadata.key") to the
+	// affinity key within the request or response proto.
+	AffinityKey string `json:"affinityKey"`
+}
+
+// methodConfig associates one or more fully-qualified method names
+// (e.g. "/pkg.Service/Method") with an affinity config.
+type methodConfig struct {
+	Name     []string        `json:"name"`
+	Affinity *AffinityConfig `json:"affinity,omitempty"`
+}
+
+// channelPoolConfig mirrors the grpc_gcp ApiConfig's channelPool field.
+type channelPoolConfig struct {
+	MaxSize                          uint32 `json:"maxSize"`
+	MaxConcurrentStreamsLowWatermark uint32 `json:"maxConcurrentStreamsLowWatermark"`
+	// DrainTimeoutSeconds bounds how long DrainSubConn waits for a
+	// SubConn's in-flight streams to finish before forcing removal.
+	DrainTimeoutSeconds uint32 `json:"drainTimeoutSeconds,omitempty"`
+}
+
+// GcpBalancerConfig is the parsed form of a grpc_gcp ApiConfig service
+// config entry. It implements serviceconfig.LoadBalancingConfig so it can be
+// carried on balancer.ClientConnState.BalancerConfig, and it is also what
+// GCPUnaryClientInterceptor/GCPStreamClientInterceptor consult to look up a
+// method's affinity config.
+type GcpBalancerConfig struct {
+	serviceconfig.LoadBalancingConfig
+
+	ChannelPool *channelPoolConfig `json:"channelPool,omitempty"`
+	Method      []methodConfig     `json:"method,omitempty"`
+
+	methodCfg map[string]*AffinityConfig
+}
+
+// ParseConfig implements balancer.ConfigParser. lbCfg is a grpc_gcp ApiConfig
+// JSON document, e.g. the "grpc_gcp" entry of a service config produced with
+// grpc.WithDefaultServiceConfig:
+//
+//	grpc.WithDefaultServiceConfig(`{
+//	  "loadBalancingConfig": [{"grpc_gcp": {
+//	    "channelPool": {"maxSize": 10, "maxConcurrentStreamsLowWatermark": 100},
+//	    "method": [{
+//	      "name": ["/google.spanner.v1.Spanner/CreateSession"],
+//	      "affinity": {"command": "BIND", "affinityKey": "name"}
+//	    }]
+//	  }}]
+//	}`)
+func (*gcpBalancerBuilder) ParseConfig(lbCfg json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	return ParseAPIConfig(lbCfg)
+}
+
+// ParseAPIConfig parses a grpc_gcp ApiConfig JSON document into a
+// GcpBalancerConfig. It is exported so the affinity interceptor can be built
+// from the same configuration that was handed to
+// grpc.WithDefaultServiceConfig.
+func ParseAPIConfig(raw json.RawMessage) (*GcpBalancerConfig, error) {
+	cfg := &GcpBalancerConfig{}
+	if err := json.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("grpcgcp: failed to unmarshal grpc_gcp ApiConfig %s: %v", string(raw), err)
+	}
+	cfg.methodCfg = make(map[string]*AffinityConfig)
+	for _, m := range cfg.Method {
+		if m.Affinity == nil {
+			continue
+		}
+		for _, name := range m.Name {
+			cfg.methodCfg[name] = m.Affinity
+		}
+	}
+	return cfg, nil
+}
+
+// maxSize returns the configured channel pool size, falling back to
+// defaultMaxConn when c is nil or unset.
+func (c *GcpBalancerConfig) maxSize() int {
+	if c == nil || c.ChannelPool == nil || c.ChannelPool.MaxSize == 0 {
+		return defaultMaxConn
+	}
+	return int(c.ChannelPool.MaxSize)
+}
+
+// maxStream returns the configured low watermark, falling back to
+// defaultMaxStream when c is nil or unset.
+func (c *GcpBalancerConfig) maxStream() int {
+	if c == nil || c.ChannelPool == nil || c.ChannelPool.MaxConcurrentStreamsLowWatermark == 0 {
+		return defaultMaxStream
+	}
+	return int(c.ChannelPool.MaxConcurrentStreamsLowWatermark)
+}
+
+// drainTimeout returns the configured grace period DrainSubConn waits for
+// a SubConn's in-flight streams to finish, falling back to
+// defaultDrainTimeout when c is nil or unset.
+func (c *GcpBalancerConfig) drainTimeout() time.Duration {
+	if c == nil || c.ChannelPool == nil || c.ChannelPool.DrainTimeoutSeconds == 0 {
+		return defaultDrainTimeout
+	}
+	return time.Duration(c.ChannelPool.DrainTimeoutSeconds) * time.Second
+}
+
+// AffinityConfigFor returns the affinity config for the given
+// fully-qualified method name, and whether one was found.
+func (c *GcpBalancerConfig) AffinityConfigFor(method string) (*AffinityConfig, bool) {
+	if c == nil {
+		return nil, false
+	}
+	cfg, ok := c.methodCfg[method]
+	return cfg, ok
+}
@@ -0,0 +1,103 @@
+/*
+ *
+ * Copyright 2018 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package grpcgcp
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseAPIConfigValid(t *testing.T) {
+	raw := json.RawMessage(`{
+		"channelPool": {"maxSize": 5, "maxConcurrentStreamsLowWatermark": 50},
+		"method": [{
+			"name": ["/google.spanner.v1.Spanner/CreateSession"],
+			"affinity": {"command": "BIND", "affinityKey": "name"}
+		}]
+	}`)
+
+	cfg, err := ParseAPIConfig(raw)
+	if err != nil {
+		t.Fatalf("ParseAPIConfig() error = %v, want nil", err)
+	}
+	if got, want := cfg.maxSize(), 5; got != want {
+		t.Errorf("maxSize() = %d, want %d", got, want)
+	}
+	if got, want := cfg.maxStream(), 50; got != want {
+		t.Errorf("maxStream() = %d, want %d", got, want)
+	}
+	affCfg, ok := cfg.AffinityConfigFor("/google.spanner.v1.Spanner/CreateSession")
+	if !ok {
+		t.Fatalf("AffinityConfigFor() ok = false, want true")
+	}
+	if affCfg.Command != BIND || affCfg.AffinityKey != "name" {
+		t.Errorf("AffinityConfigFor() = %+v, want {BIND name}", affCfg)
+	}
+}
+
+func TestParseAPIConfigDefaultsOnEmptyConfig(t *testing.T) {
+	cfg, err := ParseAPIConfig(json.RawMessage(`{}`))
+	if err != nil {
+		t.Fatalf("ParseAPIConfig() error = %v, want nil", err)
+	}
+	if got, want := cfg.maxSize(), defaultMaxConn; got != want {
+		t.Errorf("maxSize() = %d, want default %d", got, want)
+	}
+	if got, want := cfg.maxStream(), defaultMaxStream; got != want {
+		t.Errorf("maxStream() = %d, want default %d", got, want)
+	}
+	if _, ok := cfg.AffinityConfigFor("/any.Service/Method"); ok {
+		t.Errorf("AffinityConfigFor() ok = true, want false for a config with no methods")
+	}
+}
+
+func TestParseAPIConfigMalformed(t *testing.T) {
+	cases := []struct {
+		name string
+		raw  string
+	}{
+		{"not a JSON object", `["channelPool"]`},
+		{"truncated JSON", `{"channelPool": {"maxSize": 5`},
+		{"wrong type for maxSize", `{"channelPool": {"maxSize": "ten"}}`},
+		{"wrong type for method", `{"method": "bad"}`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ParseAPIConfig(json.RawMessage(c.raw)); err == nil {
+				t.Errorf("ParseAPIConfig(%s) error = nil, want non-nil", c.raw)
+			}
+		})
+	}
+}
+
+func TestGcpBalancerConfigNilReceiver(t *testing.T) {
+	var cfg *GcpBalancerConfig
+	if got, want := cfg.maxSize(), defaultMaxConn; got != want {
+		t.Errorf("maxSize() on nil config = %d, want %d", got, want)
+	}
+	if got, want := cfg.maxStream(), defaultMaxStream; got != want {
+		t.Errorf("maxStream() on nil config = %d, want %d", got, want)
+	}
+	if got, want := cfg.drainTimeout(), defaultDrainTimeout; got != want {
+		t.Errorf("drainTimeout() on nil config = %v, want %v", got, want)
+	}
+	if _, ok := cfg.AffinityConfigFor("/any.Service/Method"); ok {
+		t.Errorf("AffinityConfigFor() on nil config ok = true, want false")
+	}
+}
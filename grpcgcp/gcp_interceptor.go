@@ -0,0 +1,319 @@
+/*
+ *
+ * Copyright 2018 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package grpcgcp
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// AffinityContextKey is the context key gcpPicker.Pick consults to find the
+// affinity key an RPC should be routed by. GCPUnaryClientInterceptor and
+// GCPStreamClientInterceptor set it before invoking the RPC; third parties
+// composing their own interceptor chain can set it the same way to get
+// affinity-aware routing without going through this package's interceptors.
+type AffinityContextKey = affinityCtxKey
+
+// WithAffinityKey returns a context carrying boundKey under
+// AffinityContextKey, so a caller that builds its own interceptor chain can
+// still get affinity-aware routing out of gcpPicker.
+func WithAffinityKey(ctx context.Context, boundKey string) context.Context {
+	return ctxWithAffinityKey(ctx, boundKey)
+}
+
+// gcpInterceptor binds/unbinds affinity keys against the gcpBalancer behind
+// cc, driven by a method's AffinityConfig from the grpc_gcp ApiConfig.
+type gcpInterceptor struct {
+	cfg *GcpBalancerConfig
+}
+
+// GCPUnaryClientInterceptor returns a grpc.UnaryClientInterceptor that uses
+// cfg's per-method affinity config to route the RPC to its bound SubConn
+// (BOUND/UNBIND) and to bind/unbind the affinity key found in the response
+// (BIND/UNBIND).
+func GCPUnaryClientInterceptor(cfg *GcpBalancerConfig) grpc.UnaryClientInterceptor {
+	gi := &gcpInterceptor{cfg: cfg}
+	return func(
+		ctx context.Context,
+		method string,
+		req, reply interface{},
+		cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker,
+		opts ...grpc.CallOption,
+	) error {
+		affinityCfg, ok := gi.cfg.AffinityConfigFor(method)
+		if !ok {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		if affinityCfg.Command == BOUND || affinityCfg.Command == UNBIND {
+			if key, ok := extractAffinityKey(req, affinityCfg.AffinityKey); ok {
+				ctx = WithAffinityKey(ctx, key)
+			}
+		}
+
+		var pr *PickResult
+		if affinityCfg.Command == BIND || affinityCfg.Command == UNBIND {
+			pr = &PickResult{}
+			ctx = WithPickResult(ctx, pr)
+		}
+
+		err := invoker(ctx, method, req, reply, cc, opts...)
+
+		if err == nil && pr != nil {
+			if key, ok := extractAffinityKey(reply, affinityCfg.AffinityKey); ok {
+				applyBindCommand(pr, affinityCfg.Command, key)
+			}
+		}
+		return err
+	}
+}
+
+// GCPStreamClientInterceptor returns a grpc.StreamClientInterceptor that
+// mirrors GCPUnaryClientInterceptor's bind/unbind behavior for streaming
+// RPCs. A stream interceptor never sees the request message directly, so
+// for BOUND/UNBIND, opening the underlying stream is deferred until the
+// caller's first SendMsg, whose message is inspected for the affinity key
+// before gcpPicker.Pick runs; a caller that never calls WithAffinityKey
+// itself still gets affinity-based routing as long as the affinity key is
+// present in the first message it sends. BIND/UNBIND is applied from the
+// last message the stream receives, deferred until the stream reports
+// io.EOF; a stream that ends with any other error applies neither.
+func GCPStreamClientInterceptor(cfg *GcpBalancerConfig) grpc.StreamClientInterceptor {
+	gi := &gcpInterceptor{cfg: cfg}
+	return func(
+		ctx context.Context,
+		desc *grpc.StreamDesc,
+		cc *grpc.ClientConn,
+		method string,
+		streamer grpc.Streamer,
+		opts ...grpc.CallOption,
+	) (grpc.ClientStream, error) {
+		affinityCfg, ok := gi.cfg.AffinityConfigFor(method)
+		if !ok {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		var pr *PickResult
+		if affinityCfg.Command == BIND || affinityCfg.Command == UNBIND {
+			pr = &PickResult{}
+			ctx = WithPickResult(ctx, pr)
+		}
+
+		if affinityCfg.Command == BOUND || affinityCfg.Command == UNBIND {
+			return &deferredAffinityClientStream{
+				ctx:         ctx,
+				desc:        desc,
+				cc:          cc,
+				method:      method,
+				streamer:    streamer,
+				opts:        opts,
+				pr:          pr,
+				affinityCfg: affinityCfg,
+			}, nil
+		}
+
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &affinityClientStream{
+			ClientStream: cs,
+			pr:           pr,
+			affinityCfg:  affinityCfg,
+		}, nil
+	}
+}
+
+// affinityClientStream wraps a grpc.ClientStream to apply BIND/UNBIND from
+// the last message received once the stream closes.
+type affinityClientStream struct {
+	grpc.ClientStream
+	pr          *PickResult
+	affinityCfg *AffinityConfig
+	lastRecv    interface{}
+}
+
+func (s *affinityClientStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		s.lastRecv = m
+		return nil
+	}
+	if err == io.EOF && s.pr != nil {
+		if key, ok := extractAffinityKey(s.lastRecv, s.affinityCfg.AffinityKey); ok {
+			applyBindCommand(s.pr, s.affinityCfg.Command, key)
+		}
+	}
+	return err
+}
+
+// deferredAffinityClientStream implements grpc.ClientStream for a
+// BOUND/UNBIND streaming RPC. It postpones calling streamer, and therefore
+// gcpPicker.Pick, until the caller's first SendMsg, so the affinity key
+// found in that message can be attached to ctx ahead of the pick. Header,
+// CloseSend, Context and RecvMsg also open the stream on demand, in case a
+// caller invokes one of them before ever sending a message; Trailer does
+// not, and returns nil until the stream has been opened.
+type deferredAffinityClientStream struct {
+	ctx         context.Context
+	desc        *grpc.StreamDesc
+	cc          *grpc.ClientConn
+	method      string
+	streamer    grpc.Streamer
+	opts        []grpc.CallOption
+	pr          *PickResult
+	affinityCfg *AffinityConfig
+
+	mu       sync.Mutex
+	cs       grpc.ClientStream
+	lastRecv interface{}
+}
+
+// open establishes the underlying stream on first use, extracting the
+// affinity key from firstMsg (the caller's first outgoing message, or nil
+// if opened from something other than SendMsg) and attaching it to ctx.
+func (s *deferredAffinityClientStream) open(firstMsg interface{}) (grpc.ClientStream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cs != nil {
+		return s.cs, nil
+	}
+	ctx := s.ctx
+	if key, ok := extractAffinityKey(firstMsg, s.affinityCfg.AffinityKey); ok {
+		ctx = WithAffinityKey(ctx, key)
+	}
+	cs, err := s.streamer(ctx, s.desc, s.cc, s.method, s.opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.cs = cs
+	return cs, nil
+}
+
+func (s *deferredAffinityClientStream) Header() (metadata.MD, error) {
+	cs, err := s.open(nil)
+	if err != nil {
+		return nil, err
+	}
+	return cs.Header()
+}
+
+func (s *deferredAffinityClientStream) Trailer() metadata.MD {
+	s.mu.Lock()
+	cs := s.cs
+	s.mu.Unlock()
+	if cs == nil {
+		return nil
+	}
+	return cs.Trailer()
+}
+
+func (s *deferredAffinityClientStream) CloseSend() error {
+	cs, err := s.open(nil)
+	if err != nil {
+		return err
+	}
+	return cs.CloseSend()
+}
+
+func (s *deferredAffinityClientStream) Context() context.Context {
+	cs, err := s.open(nil)
+	if err != nil {
+		return s.ctx
+	}
+	return cs.Context()
+}
+
+func (s *deferredAffinityClientStream) SendMsg(m interface{}) error {
+	cs, err := s.open(m)
+	if err != nil {
+		return err
+	}
+	return cs.SendMsg(m)
+}
+
+func (s *deferredAffinityClientStream) RecvMsg(m interface{}) error {
+	cs, err := s.open(nil)
+	if err != nil {
+		return err
+	}
+	err = cs.RecvMsg(m)
+	if err == nil {
+		s.mu.Lock()
+		s.lastRecv = m
+		s.mu.Unlock()
+		return nil
+	}
+	if err == io.EOF && s.pr != nil {
+		s.mu.Lock()
+		lastRecv := s.lastRecv
+		s.mu.Unlock()
+		if key, ok := extractAffinityKey(lastRecv, s.affinityCfg.AffinityKey); ok {
+			applyBindCommand(s.pr, s.affinityCfg.Command, key)
+		}
+	}
+	return err
+}
+
+// applyBindCommand binds or unbinds key on the SubConn recorded in pr by
+// gcpPicker.Pick.
+func applyBindCommand(pr *PickResult, cmd AffinityCommand, key string) {
+	switch cmd {
+	case BIND:
+		pr.Bind(key)
+	case UNBIND:
+		pr.Unbind(key)
+	}
+}
+
+// extractAffinityKey walks fieldPath (e.g. "metadata.key") through msg's
+// proto reflection to find the affinity key.
+func extractAffinityKey(msg interface{}, fieldPath string) (string, bool) {
+	pm, ok := msg.(proto.Message)
+	if !ok || fieldPath == "" {
+		return "", false
+	}
+	m := pm.ProtoReflect()
+	fields := strings.Split(fieldPath, ".")
+	for i, name := range fields {
+		fd := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			return "", false
+		}
+		if i == len(fields)-1 {
+			if fd.Kind() != protoreflect.StringKind {
+				return "", false
+			}
+			return m.Get(fd).String(), true
+		}
+		if fd.Kind() != protoreflect.MessageKind {
+			return "", false
+		}
+		m = m.Get(fd).Message()
+	}
+	return "", false
+}
@@ -0,0 +1,362 @@
+/*
+ *
+ * Copyright 2018 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package grpcgcp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testOuterDesc describes a small proto3 message used only by this file to
+// exercise extractAffinityKey's field-path walking without depending on any
+// generated .pb.go package: a top-level string field ("name"), a top-level
+// non-string field ("count", to test the wrong-kind rejection), and a
+// nested message field ("metadata.key", to test multi-segment paths).
+var testOuterDesc = func() protoreflect.MessageDescriptor {
+	label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("grpcgcp_interceptor_test.proto"),
+		Package: proto.String("grpcgcptest"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Inner"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{
+						Name:   proto.String("key"),
+						Number: proto.Int32(1),
+						Label:  label,
+						Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+					},
+				},
+			},
+			{
+				Name: proto.String("Outer"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					{
+						Name:     proto.String("metadata"),
+						Number:   proto.Int32(1),
+						Label:    label,
+						Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+						TypeName: proto.String(".grpcgcptest.Inner"),
+					},
+					{
+						Name:   proto.String("name"),
+						Number: proto.Int32(2),
+						Label:  label,
+						Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+					},
+					{
+						Name:   proto.String("count"),
+						Number: proto.Int32(3),
+						Label:  label,
+						Type:   descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(),
+					},
+				},
+			},
+		},
+	}
+	files, err := protodesc.NewFile(fd, nil)
+	if err != nil {
+		panic(err)
+	}
+	return files.Messages().ByName("Outer")
+}()
+
+// newTestOuterMsg builds an Outer test message with the given top-level
+// name, nested metadata.key, and count, leaving any zero-valued argument
+// unset.
+func newTestOuterMsg(name, metadataKey string, count int32) proto.Message {
+	m := dynamicpb.NewMessageType(testOuterDesc).New()
+	if name != "" {
+		m.Set(testOuterDesc.Fields().ByName("name"), protoreflect.ValueOfString(name))
+	}
+	if count != 0 {
+		m.Set(testOuterDesc.Fields().ByName("count"), protoreflect.ValueOfInt32(count))
+	}
+	if metadataKey != "" {
+		metadataFD := testOuterDesc.Fields().ByName("metadata")
+		inner := m.NewField(metadataFD).Message()
+		inner.Set(inner.Descriptor().Fields().ByName("key"), protoreflect.ValueOfString(metadataKey))
+		m.Set(metadataFD, protoreflect.ValueOfMessage(inner))
+	}
+	return m.Interface()
+}
+
+func TestExtractAffinityKeyTopLevelField(t *testing.T) {
+	msg := newTestOuterMsg("top-key", "", 0)
+	key, ok := extractAffinityKey(msg, "name")
+	if !ok || key != "top-key" {
+		t.Errorf(`extractAffinityKey(msg, "name") = (%q, %v), want ("top-key", true)`, key, ok)
+	}
+}
+
+func TestExtractAffinityKeyNestedField(t *testing.T) {
+	msg := newTestOuterMsg("", "nested-key", 0)
+	key, ok := extractAffinityKey(msg, "metadata.key")
+	if !ok || key != "nested-key" {
+		t.Errorf(`extractAffinityKey(msg, "metadata.key") = (%q, %v), want ("nested-key", true)`, key, ok)
+	}
+}
+
+func TestExtractAffinityKeyMissingField(t *testing.T) {
+	msg := newTestOuterMsg("top-key", "", 0)
+	if _, ok := extractAffinityKey(msg, "nope"); ok {
+		t.Errorf(`extractAffinityKey(msg, "nope") ok = true, want false`)
+	}
+}
+
+func TestExtractAffinityKeyWrongKind(t *testing.T) {
+	msg := newTestOuterMsg("", "", 42)
+	if _, ok := extractAffinityKey(msg, "count"); ok {
+		t.Errorf(`extractAffinityKey(msg, "count") ok = true for a non-string field, want false`)
+	}
+}
+
+func TestExtractAffinityKeyNotAMessage(t *testing.T) {
+	if _, ok := extractAffinityKey("not a proto.Message", "name"); ok {
+		t.Errorf("extractAffinityKey() ok = true for a non-proto.Message value, want false")
+	}
+}
+
+func TestExtractAffinityKeyEmptyPath(t *testing.T) {
+	msg := newTestOuterMsg("top-key", "", 0)
+	if _, ok := extractAffinityKey(msg, ""); ok {
+		t.Errorf(`extractAffinityKey(msg, "") ok = true, want false`)
+	}
+}
+
+func affinityMethodConfig(t *testing.T, method, command, affinityKey string) *GcpBalancerConfig {
+	t.Helper()
+	raw, err := json.Marshal(map[string]interface{}{
+		"method": []map[string]interface{}{{
+			"name":     []string{method},
+			"affinity": map[string]string{"command": command, "affinityKey": affinityKey},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	cfg, err := ParseAPIConfig(raw)
+	if err != nil {
+		t.Fatalf("ParseAPIConfig() error = %v", err)
+	}
+	return cfg
+}
+
+func TestGCPUnaryClientInterceptorBoundRoutesFromRequest(t *testing.T) {
+	cfg := affinityMethodConfig(t, "/test.Service/Get", "BOUND", "name")
+	interceptor := GCPUnaryClientInterceptor(cfg)
+
+	var gotKey string
+	var gotOK bool
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		gotKey, gotOK = affinityKeyFromContext(ctx)
+		return nil
+	}
+
+	req := newTestOuterMsg("bound-key", "", 0)
+	if err := interceptor(context.Background(), "/test.Service/Get", req, nil, nil, invoker); err != nil {
+		t.Fatalf("interceptor error = %v", err)
+	}
+	if !gotOK || gotKey != "bound-key" {
+		t.Errorf("affinity key seen by invoker = (%q, %v), want (\"bound-key\", true)", gotKey, gotOK)
+	}
+}
+
+func TestGCPUnaryClientInterceptorBindsAfterRPCCompletes(t *testing.T) {
+	gb := newTestBalancer(&fakeClientConn{}, &GcpBalancerConfig{})
+	sc := &fakeSubConn{}
+	gb.scRefs[sc] = &subConnRef{subConn: sc}
+
+	cfg := affinityMethodConfig(t, "/test.Service/Create", "BIND", "name")
+	interceptor := GCPUnaryClientInterceptor(cfg)
+
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		// Before the RPC returns, Bind must not have fired yet.
+		if _, ok := gb.affinityMap["bound-key"]; ok {
+			t.Errorf("affinity key bound before the RPC completed")
+		}
+		if pr, ok := pickResultFromContext(ctx); ok {
+			pr.gb = gb
+			pr.sc = sc
+		}
+		return nil
+	}
+
+	reply := newTestOuterMsg("bound-key", "", 0)
+	if err := interceptor(context.Background(), "/test.Service/Create", newTestOuterMsg("", "", 0), reply, nil, invoker); err != nil {
+		t.Fatalf("interceptor error = %v", err)
+	}
+	if _, ok := gb.affinityMap["bound-key"]; !ok {
+		t.Errorf("affinity key was not bound after the RPC completed")
+	}
+}
+
+func TestGCPUnaryClientInterceptorUnbindsAfterRPCCompletes(t *testing.T) {
+	gb := newTestBalancer(&fakeClientConn{}, &GcpBalancerConfig{})
+	sc := &fakeSubConn{}
+	gb.scRefs[sc] = &subConnRef{subConn: sc}
+	gb.bindSubConn("bound-key", sc)
+
+	cfg := affinityMethodConfig(t, "/test.Service/Delete", "UNBIND", "name")
+	interceptor := GCPUnaryClientInterceptor(cfg)
+
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		if key, ok := affinityKeyFromContext(ctx); !ok || key != "bound-key" {
+			t.Errorf("affinity key seen by invoker = (%q, %v), want (\"bound-key\", true)", key, ok)
+		}
+		if _, ok := gb.affinityMap["bound-key"]; !ok {
+			t.Errorf("affinity key unbound before the RPC completed")
+		}
+		if pr, ok := pickResultFromContext(ctx); ok {
+			pr.gb = gb
+			pr.sc = sc
+		}
+		return nil
+	}
+
+	req := newTestOuterMsg("bound-key", "", 0)
+	reply := newTestOuterMsg("bound-key", "", 0)
+	if err := interceptor(context.Background(), "/test.Service/Delete", req, reply, nil, invoker); err != nil {
+		t.Fatalf("interceptor error = %v", err)
+	}
+	if _, ok := gb.affinityMap["bound-key"]; ok {
+		t.Errorf("affinity key still bound after the RPC completed")
+	}
+}
+
+// fakeClientStream is a grpc.ClientStream double. SendMsg records every
+// message sent; RecvMsg copies from a canned list of responses and
+// returns io.EOF once exhausted.
+type fakeClientStream struct {
+	ctx      context.Context
+	sent     []proto.Message
+	recvMsgs []proto.Message
+	recvIdx  int
+}
+
+func (s *fakeClientStream) Header() (metadata.MD, error) { return nil, nil }
+func (s *fakeClientStream) Trailer() metadata.MD         { return nil }
+func (s *fakeClientStream) CloseSend() error             { return nil }
+func (s *fakeClientStream) Context() context.Context     { return s.ctx }
+
+func (s *fakeClientStream) SendMsg(m interface{}) error {
+	s.sent = append(s.sent, m.(proto.Message))
+	return nil
+}
+
+func (s *fakeClientStream) RecvMsg(m interface{}) error {
+	if s.recvIdx >= len(s.recvMsgs) {
+		return io.EOF
+	}
+	proto.Merge(m.(proto.Message), s.recvMsgs[s.recvIdx])
+	s.recvIdx++
+	return nil
+}
+
+func TestGCPStreamClientInterceptorBoundDefersUntilFirstSendMsg(t *testing.T) {
+	cfg := affinityMethodConfig(t, "/test.Service/Watch", "BOUND", "name")
+	interceptor := GCPStreamClientInterceptor(cfg)
+
+	fcs := &fakeClientStream{ctx: context.Background()}
+	var streamerCalled bool
+	var seenCtx context.Context
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		streamerCalled = true
+		seenCtx = ctx
+		return fcs, nil
+	}
+
+	cs, err := interceptor(context.Background(), &grpc.StreamDesc{}, nil, "/test.Service/Watch", streamer)
+	if err != nil {
+		t.Fatalf("interceptor error = %v", err)
+	}
+	if streamerCalled {
+		t.Fatalf("streamer was invoked before the first SendMsg; BOUND routing must defer stream creation")
+	}
+
+	if err := cs.SendMsg(newTestOuterMsg("bound-key", "", 0)); err != nil {
+		t.Fatalf("SendMsg() error = %v", err)
+	}
+	if !streamerCalled {
+		t.Fatalf("streamer was never invoked after SendMsg")
+	}
+	if key, ok := affinityKeyFromContext(seenCtx); !ok || key != "bound-key" {
+		t.Errorf("affinity key seen by streamer = (%q, %v), want (\"bound-key\", true)", key, ok)
+	}
+	if len(fcs.sent) != 1 {
+		t.Fatalf("sent = %d messages, want 1", len(fcs.sent))
+	}
+}
+
+func TestGCPStreamClientInterceptorUnbindsOnEOFNotBefore(t *testing.T) {
+	gb := newTestBalancer(&fakeClientConn{}, &GcpBalancerConfig{})
+	sc := &fakeSubConn{}
+	gb.scRefs[sc] = &subConnRef{subConn: sc}
+	gb.bindSubConn("bound-key", sc)
+
+	cfg := affinityMethodConfig(t, "/test.Service/Watch", "UNBIND", "name")
+	interceptor := GCPStreamClientInterceptor(cfg)
+
+	fcs := &fakeClientStream{
+		ctx:      context.Background(),
+		recvMsgs: []proto.Message{newTestOuterMsg("bound-key", "", 0)},
+	}
+	streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if pr, ok := pickResultFromContext(ctx); ok {
+			pr.gb = gb
+			pr.sc = sc
+		}
+		return fcs, nil
+	}
+
+	cs, err := interceptor(context.Background(), &grpc.StreamDesc{}, nil, "/test.Service/Watch", streamer)
+	if err != nil {
+		t.Fatalf("interceptor error = %v", err)
+	}
+	if err := cs.SendMsg(newTestOuterMsg("bound-key", "", 0)); err != nil {
+		t.Fatalf("SendMsg() error = %v", err)
+	}
+
+	resp := newTestOuterMsg("", "", 0)
+	if err := cs.RecvMsg(resp); err != nil {
+		t.Fatalf("first RecvMsg() error = %v, want nil", err)
+	}
+	if _, ok := gb.affinityMap["bound-key"]; !ok {
+		t.Errorf("affinity key unbound before the stream reported io.EOF")
+	}
+
+	if err := cs.RecvMsg(resp); err != io.EOF {
+		t.Fatalf("second RecvMsg() error = %v, want io.EOF", err)
+	}
+	if _, ok := gb.affinityMap["bound-key"]; ok {
+		t.Errorf("affinity key still bound after the stream reported io.EOF")
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ *
+ * Copyright 2018 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package grpcgcp
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+)
+
+// affinityCtxKey is the context key under which a bound affinity key is
+// stashed so that gcpPicker.Pick can route the RPC to the SubConn it is
+// bound to.
+type affinityCtxKey struct{}
+
+func ctxWithAffinityKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, affinityCtxKey{}, key)
+}
+
+func affinityKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(affinityCtxKey{}).(string)
+	return key, ok && key != ""
+}
+
+// pickResultCtxKey is the context key under which gcpPicker.Pick records
+// which balancer and SubConn served an RPC, so that an interceptor wrapping
+// the call can later bind/unbind an affinity key to that SubConn.
+type pickResultCtxKey struct{}
+
+// PickResult is the picker→interceptor half of the affinity context
+// contract: a caller that wants to bind/unbind against whichever SubConn
+// ends up serving its RPC attaches a *PickResult to the outgoing context
+// before invoking the call, and Pick fills it in.
+type PickResult struct {
+	gb *gcpBalancer
+	sc balancer.SubConn
+}
+
+// WithPickResult returns a context carrying pr, which gcpPicker.Pick will
+// populate with the balancer and SubConn it chooses for the RPC made with
+// the returned context.
+func WithPickResult(ctx context.Context, pr *PickResult) context.Context {
+	return context.WithValue(ctx, pickResultCtxKey{}, pr)
+}
+
+func pickResultFromContext(ctx context.Context) (*PickResult, bool) {
+	pr, ok := ctx.Value(pickResultCtxKey{}).(*PickResult)
+	return pr, ok
+}
+
+// Bind binds boundKey to the SubConn that served the RPC this PickResult was
+// attached to. It is a no-op if the RPC never reached Pick.
+func (pr *PickResult) Bind(boundKey string) {
+	if pr == nil || pr.gb == nil {
+		return
+	}
+	pr.gb.bindSubConn(boundKey, pr.sc)
+}
+
+// Unbind releases the binding for boundKey on the balancer that served the
+// RPC this PickResult was attached to. It is a no-op if the RPC never
+// reached Pick.
+func (pr *PickResult) Unbind(boundKey string) {
+	if pr == nil || pr.gb == nil {
+		return
+	}
+	pr.gb.unbindSubConn(boundKey)
+}
+
+// gcpPicker is a balancer.Picker that routes RPCs to a bound SubConn when the
+// incoming context carries an affinity key, and otherwise picks the
+// least-loaded ready SubConn. It also grows the pool when the least-loaded
+// SubConn is at or above the configured stream watermark.
+type gcpPicker struct {
+	mu      sync.Mutex
+	scRefs  []*subConnRef
+	gcpBa   *gcpBalancer
+	nextIdx int
+}
+
+// newGCPPicker builds a gcpPicker out of the given ready SubConn references.
+func newGCPPicker(scRefs []*subConnRef, gb *gcpBalancer) *gcpPicker {
+	return &gcpPicker{
+		scRefs: scRefs,
+		gcpBa:  gb,
+	}
+}
+
+// Pick implements balancer.Picker.
+func (p *gcpPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.scRefs) <= 0 {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+
+	leastLoaded := p.leastLoadedRef()
+	ref := leastLoaded
+	if boundKey, ok := affinityKeyFromContext(info.Ctx); ok {
+		if bound, found := p.gcpBa.getReadySubConnRef(boundKey); found {
+			if bound == nil {
+				// The bound SubConn is not READY yet; wait for it rather
+				// than sending the RPC to another SubConn.
+				return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+			}
+			ref = bound
+		}
+	}
+
+	if pr, ok := pickResultFromContext(info.Ctx); ok {
+		pr.gb = p.gcpBa
+		pr.sc = ref.subConn
+	}
+
+	// Incremented before the growth check below so that, when ref is
+	// leastLoaded, this pick's own stream is already counted; otherwise
+	// the pool would only grow on the watermark's (N+1)th pick instead of
+	// its Nth.
+	ref.streamsIncr()
+
+	// The growth decision is driven by the least-loaded ref, not by ref
+	// itself: ref may be an affinity-bound SubConn that isn't
+	// representative of how busy the rest of the pool is.
+	if int(atomic.LoadInt32(&leastLoaded.streamsCnt)) >= p.gcpBa.loadCfg().maxStream() && len(p.scRefs) < p.gcpBa.loadCfg().maxSize() {
+		// Grow the pool in the background; this pick still goes to ref.
+		go p.gcpBa.newSubConn()
+	}
+
+	return balancer.PickResult{
+		SubConn: ref.subConn,
+		Done: func(balancer.DoneInfo) {
+			ref.streamsDecr()
+		},
+	}, nil
+}
+
+// leastLoadedRef returns the ready SubConn with the fewest in-flight
+// streams, falling back to round-robin on ties. It ignores affinity
+// bindings entirely, so it reflects how busy the pool as a whole is, which
+// is what the pool-growth decision in Pick needs even when the RPC itself
+// is dispatched to an affinity-bound SubConn.
+func (p *gcpPicker) leastLoadedRef() *subConnRef {
+	ref := p.scRefs[p.nextIdx%len(p.scRefs)]
+	for _, r := range p.scRefs {
+		if atomic.LoadInt32(&r.streamsCnt) < atomic.LoadInt32(&ref.streamsCnt) {
+			ref = r
+		}
+	}
+	p.nextIdx++
+	return ref
+}
+
+// errPicker always returns the same error on Pick.
+type errPicker struct {
+	err error
+}
+
+func newErrPicker(err error) *errPicker {
+	return &errPicker{err: err}
+}
+
+func (p *errPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	return balancer.PickResult{}, p.err
+}
@@ -0,0 +1,144 @@
+/*
+ *
+ * Copyright 2018 gRPC authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package grpcgcp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+)
+
+// newTestBalancer builds a gcpBalancer wired to cc and cfg without going
+// through the builder, so tests can drive its unexported state directly.
+func newTestBalancer(cc balancer.ClientConn, cfg *GcpBalancerConfig) *gcpBalancer {
+	gb := &gcpBalancer{
+		cc:          cc,
+		affinityMap: make(map[string]balancer.SubConn),
+		scRefs:      make(map[balancer.SubConn]*subConnRef),
+		scStates:    make(map[balancer.SubConn]connectivity.State),
+		csEvltr:     &ConnectivityStateEvaluator{},
+		picker:      newErrPicker(balancer.ErrNoSubConnAvailable),
+	}
+	gb.storeCfg(cfg)
+	return gb
+}
+
+func TestPickerGrowsPoolAtWatermarkAndShrinksInUse(t *testing.T) {
+	cc := &fakeClientConn{}
+	cfg := &GcpBalancerConfig{ChannelPool: &channelPoolConfig{
+		MaxSize:                          2,
+		MaxConcurrentStreamsLowWatermark: 2,
+	}}
+	gb := newTestBalancer(cc, cfg)
+	gb.addrs = []resolver.Address{{Addr: "127.0.0.1:1"}}
+
+	gb.newSubConn()
+	if got := cc.subConnCount(); got != 1 {
+		t.Fatalf("subConnCount() = %d, want 1", got)
+	}
+	sc := cc.subConnAt(0)
+	gb.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+
+	picker, ok := gb.picker.(*gcpPicker)
+	if !ok {
+		t.Fatalf("gb.picker is a %T, want *gcpPicker", gb.picker)
+	}
+
+	// Drive the single ready SubConn's streamsCnt up to the watermark; at
+	// that point Pick should ask the balancer to grow the pool, without
+	// blocking the picks already in flight.
+	var dones []func(balancer.DoneInfo)
+	for i := 0; i < 2; i++ {
+		res, err := picker.Pick(balancer.PickInfo{Ctx: context.Background()})
+		if err != nil {
+			t.Fatalf("Pick() error = %v", err)
+		}
+		dones = append(dones, res.Done)
+	}
+
+	waitUntil(t, time.Second, func() bool { return cc.subConnCount() == 2 })
+
+	ref := picker.scRefs[0]
+	if got := ref.streamsCnt; got != 2 {
+		t.Fatalf("streamsCnt = %d, want 2", got)
+	}
+	for _, done := range dones {
+		done(balancer.DoneInfo{})
+	}
+	if got := ref.streamsCnt; got != 0 {
+		t.Fatalf("streamsCnt after Done = %d, want 0 (in-use count should shrink back down)", got)
+	}
+}
+
+func TestPickerPrefersLeastLoadedSubConn(t *testing.T) {
+	busy := &subConnRef{subConn: &fakeSubConn{}, streamsCnt: 5}
+	idle := &subConnRef{subConn: &fakeSubConn{}, streamsCnt: 1}
+	gb := newTestBalancer(&fakeClientConn{}, &GcpBalancerConfig{})
+	picker := newGCPPicker([]*subConnRef{busy, idle}, gb)
+
+	res, err := picker.Pick(balancer.PickInfo{Ctx: context.Background()})
+	if err != nil {
+		t.Fatalf("Pick() error = %v", err)
+	}
+	if res.SubConn != idle.subConn {
+		t.Fatalf("Pick() routed to the busier SubConn, want the least-loaded one")
+	}
+}
+
+func TestPickerGrowthIgnoresAffinityBoundSubConn(t *testing.T) {
+	// A request bound to a busy SubConn must not be rerouted, but the
+	// growth decision must still be based on the pool's least-loaded
+	// SubConn, not the busy one the affinity key pins the RPC to.
+	cc := &fakeClientConn{}
+	cfg := &GcpBalancerConfig{ChannelPool: &channelPoolConfig{
+		MaxSize:                          3,
+		MaxConcurrentStreamsLowWatermark: 2,
+	}}
+	gb := newTestBalancer(cc, cfg)
+	gb.addrs = []resolver.Address{{Addr: "127.0.0.1:1"}}
+
+	boundSC := &fakeSubConn{}
+	boundRef := &subConnRef{subConn: boundSC, streamsCnt: 10}
+	gb.scRefs[boundSC] = boundRef
+	gb.scStates[boundSC] = connectivity.Ready
+	gb.affinityMap["key"] = boundSC
+
+	idleSC := &fakeSubConn{}
+	idleRef := &subConnRef{subConn: idleSC, streamsCnt: 0}
+	gb.scRefs[idleSC] = idleRef
+	gb.scStates[idleSC] = connectivity.Ready
+
+	picker := newGCPPicker([]*subConnRef{boundRef, idleRef}, gb)
+	ctx := WithAffinityKey(context.Background(), "key")
+
+	res, err := picker.Pick(balancer.PickInfo{Ctx: ctx})
+	if err != nil {
+		t.Fatalf("Pick() error = %v", err)
+	}
+	if res.SubConn != boundSC {
+		t.Fatalf("Pick() did not honor the affinity binding")
+	}
+	if got := cc.subConnCount(); got != 0 {
+		t.Fatalf("subConnCount() = %d, want 0: pool should not grow off the idle pool's state", got)
+	}
+}